@@ -2,10 +2,14 @@ package turtle
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"reflect"
 	"strings"
 )
 
@@ -28,7 +32,9 @@ func isValidAuthMode(mode string) bool {
 type CtxCredentials struct{}
 
 // ErrorWriter implements error handling for bundled routes.
-// Each function should write to the ResponseWriter.
+// Each function should write to the ResponseWriter. r is provided so
+// implementations can negotiate content type from its headers and pull
+// request-scoped values (e.g. a *slog.Logger) from r.Context().
 // No further writing to the ResponseWriter should occur.
 type ErrorWriter interface {
 	Unauthorized(w http.ResponseWriter, r *http.Request, err error)
@@ -43,6 +49,30 @@ type Roler interface {
 	HasRole(role string) bool
 }
 
+// Scoper is an interface used during scope authorization to validate that
+// the implementer carries the required OAuth-style scope. A single
+// credential object may implement both Roler and Scoper.
+type Scoper interface {
+	HasScope(scope string) bool
+}
+
+// Scheme authenticates incoming requests for a single authentication method
+// (e.g. Basic, Bearer, an API key). Register implementations with
+// Bundler.RegisterScheme and reference them by name in O.Schemes.
+type Scheme interface {
+	// Authenticate attempts to authenticate r, returning the credentials to
+	// store in CtxCredentials. A non-nil error means authentication failed.
+	Authenticate(w http.ResponseWriter, r *http.Request) (interface{}, error)
+}
+
+// Challenger is implemented by a Scheme that can describe itself as a
+// WWW-Authenticate challenge (RFC 7235), e.g. `Basic realm="api"`. bundle.authenticate
+// collects a challenge from every Scheme tried so a 401 response can advertise
+// all acceptable schemes at once.
+type Challenger interface {
+	Challenge(r *http.Request) string
+}
+
 // Bundler bundles authentication, authorization, validation and per HandlerFunc logic into a nice package.
 type Bundler struct {
 	schemes       map[string]Scheme
@@ -58,6 +88,12 @@ func NewBundler(ew ErrorWriter) *Bundler {
 	}
 }
 
+// SetErrorWriter replaces the Bundler-wide default ErrorWriter. Routes that set
+// O.ErrorWriter still override this on a per-route basis.
+func (b *Bundler) SetErrorWriter(ew ErrorWriter) {
+	b.ew = ew
+}
+
 // RegisterScheme registers the scheme by name with bundler.
 // It can then be used in O.Schemes.
 func (b *Bundler) RegisterScheme(name string, scheme Scheme) {
@@ -76,13 +112,16 @@ func (b *Bundler) SetDefaultScheme(name string) error {
 
 // O are options to pass to Bundle.
 type O struct {
-	Allow       []string     // Content-Types to allow.
-	Roles       []string     // Roles to allow, object in request context with key CtxCredentials must implement Roler.
-	Schemes     []string     // A series of authentication schemes to try in order. Must be a key in Bundler.SchemeMap.
-	AuthMode    string       // 'try', 'required', 'none'.
-	Before      []HandleWrap // A series of HandlerFuncs to execute before Handle.
-	After       []HandleWrap // A serios of HandlerFuncs to execute after Handle.
-	HandlerFunc func(http.ResponseWriter, *http.Request)
+	Allow         []string     // Content-Types to allow.
+	Roles         []string     // Roles to allow, object in request context with key CtxCredentials must implement Roler. Sugar for a single RequiredRoles OR group.
+	RequiredRoles [][]string   // Roles to allow, expressed as OR-of-AND groups: [["admin","billing"],["support"]] means (admin AND billing) OR (support). Mutually exclusive with Roles.
+	Scopes        []string     // Scopes to require, object in request context with key CtxCredentials must implement Scoper. Requires AuthMode AUTHMODEREQUIRED.
+	Schemes       []string     // A series of authentication schemes to try in order. Must be a key in Bundler.SchemeMap.
+	AuthMode      string       // 'try', 'required', 'none'.
+	Before        []HandleWrap // A series of HandlerFuncs to execute before Handle.
+	After         []HandleWrap // A serios of HandlerFuncs to execute after Handle.
+	ErrorWriter   ErrorWriter  // Overrides the Bundler-wide ErrorWriter for this route. Nil means use the Bundler's.
+	HandlerFunc   func(http.ResponseWriter, *http.Request)
 }
 
 // HandleWrap is a function that takes a HandlerFunc and returns a HandlerFunc.
@@ -105,8 +144,19 @@ func (b *Bundler) New(options O) func(http.ResponseWriter, *http.Request) {
 	if !isValidAuthMode(options.AuthMode) {
 		panic(fmt.Sprintf("invalid auth mode: %s", options.AuthMode))
 	}
-	if options.AuthMode != AUTHMODEREQUIRED && len(options.Roles) != 0 {
-		panic(fmt.Sprintf("invalid authentication mode %s for amount of roles %d", options.AuthMode, len(options.Roles)))
+	if options.AuthMode != AUTHMODEREQUIRED && (len(options.Roles) != 0 || len(options.RequiredRoles) != 0) {
+		panic(fmt.Sprintf("invalid authentication mode %s for amount of roles %d", options.AuthMode, len(options.Roles)+len(options.RequiredRoles)))
+	}
+	if len(options.Roles) != 0 && len(options.RequiredRoles) != 0 {
+		panic("O.Roles and O.RequiredRoles are mutually exclusive")
+	}
+	for _, group := range options.RequiredRoles {
+		if len(group) == 0 {
+			panic("O.RequiredRoles contains an empty group, which is vacuously satisfied by everyone")
+		}
+	}
+	if options.AuthMode != AUTHMODEREQUIRED && len(options.Scopes) != 0 {
+		panic(fmt.Sprintf("invalid authentication mode %s for amount of scopes %d", options.AuthMode, len(options.Scopes)))
 	}
 	for _, k := range options.Schemes {
 		if _, ok := b.schemes[k]; !ok {
@@ -123,6 +173,7 @@ func (b *Bundler) New(options O) func(http.ResponseWriter, *http.Request) {
 	// Prepend auth HandlerFunc chain.
 	bindle.chain = append(bindle.chain, bindle.authenticate)
 	bindle.chain = append(bindle.chain, bindle.authorize)
+	bindle.chain = append(bindle.chain, bindle.authorizeScope)
 	bindle.chain = append(bindle.chain, bindle.allow)
 	bindle.chain = append(bindle.chain, bindle.opts.Before...)
 
@@ -130,7 +181,7 @@ func (b *Bundler) New(options O) func(http.ResponseWriter, *http.Request) {
 	for i := (len(bindle.chain) - 1); i >= 0; i-- {
 		bindle.opts.HandlerFunc = bindle.chain[i](bindle.opts.HandlerFunc)
 	}
-	var after func(http.ResponseWriter, *http.Request)
+	after := func(http.ResponseWriter, *http.Request) {}
 	for i := (len(bindle.opts.After) - 1); i >= 0; i-- {
 		after = bindle.opts.After[i](after)
 	}
@@ -141,33 +192,177 @@ func (b *Bundler) New(options O) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+var errType = reflect.TypeOf((*error)(nil)).Elem()
+var ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+var responseWriterType = reflect.TypeOf((*http.ResponseWriter)(nil)).Elem()
+var requestType = reflect.TypeOf((*http.Request)(nil))
+
+// NewTyped is like New but takes a typed handler instead of O.HandlerFunc,
+// removing the JSON decode/encode boilerplate from the application. handler
+// must have one of these signatures:
+//
+//	func(w http.ResponseWriter, r *http.Request, req In) (Out, error)
+//	func(ctx context.Context, credentials Cred, req In) (Out, error)
+//
+// In and Out may be any JSON-decodable/encodable type; Cred is asserted from
+// CtxCredentials. The request body is always decoded as JSON — turtle does
+// not ship other codecs, so there is nothing to negotiate against. An empty
+// body decodes to the zero value of In. Because of this, O.Allow must be
+// empty or contain only "application/json"; NewTyped panics at registration
+// time otherwise, so O.Allow can never advertise a media type the route
+// doesn't actually accept. NewTyped also panics if handler does not match
+// one of the shapes above, for the same reason Bundler.New panics on invalid
+// options: we don't want the app to run with a broken route.
+func (b *Bundler) NewTyped(options O, handler interface{}) func(http.ResponseWriter, *http.Request) {
+	for _, allowed := range options.Allow {
+		if allowed != "application/json" {
+			panic(fmt.Sprintf("turtle: NewTyped only decodes application/json, invalid O.Allow entry: %s", allowed))
+		}
+	}
+	adapter := newTypedAdapter(handler)
+	options.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		adapter(w, r, b.ewFor(options))
+	}
+	return b.New(options)
+}
+
+// ewFor returns the ErrorWriter a route with options would use, without
+// requiring a constructed bundle.
+func (b *Bundler) ewFor(options O) ErrorWriter {
+	return resolveErrorWriter(b.ew, options.ErrorWriter)
+}
+
+// typedHandler decodes req from the request body, invokes the wrapped
+// handler, and encodes its result as the response.
+type typedHandler func(w http.ResponseWriter, r *http.Request, ew ErrorWriter)
+
+func newTypedAdapter(handler interface{}) typedHandler {
+	v := reflect.ValueOf(handler)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 3 || t.NumOut() != 2 {
+		panic(fmt.Sprintf("turtle: NewTyped handler has invalid signature: %s", t))
+	}
+	if !t.Out(1).Implements(errType) {
+		panic(fmt.Sprintf("turtle: NewTyped handler's second return value must be error, got %s", t.Out(1)))
+	}
+
+	var withCredentials bool
+	switch {
+	case t.In(0) == responseWriterType && t.In(1) == requestType:
+		withCredentials = false
+	case t.In(0) == ctxType:
+		withCredentials = true
+	default:
+		panic(fmt.Sprintf("turtle: NewTyped handler's first two arguments must be (http.ResponseWriter, *http.Request) or (context.Context, credentials): %s", t))
+	}
+
+	reqType := t.In(2)
+	credType := t.In(1)
+
+	return func(w http.ResponseWriter, r *http.Request, ew ErrorWriter) {
+		req := reflect.New(reqType)
+		if err := json.NewDecoder(r.Body).Decode(req.Interface()); err != nil && err != io.EOF {
+			ew.BadRequest(w, r, fmt.Errorf("decode request body: %w", err))
+			return
+		}
+
+		var args []reflect.Value
+		var tracker *writeTracker
+		if withCredentials {
+			creds := r.Context().Value(CtxCredentials{})
+			cv := reflect.ValueOf(creds)
+			if !cv.IsValid() || !cv.Type().AssignableTo(credType) {
+				ew.ServerError(w, r, fmt.Errorf("CtxCredentials does not implement %s", credType))
+				return
+			}
+			args = []reflect.Value{reflect.ValueOf(r.Context()), cv, req.Elem()}
+		} else {
+			// The handler is handed w directly and may write its own response;
+			// track whether it did so we don't also encode our own on top of it.
+			tracker = &writeTracker{ResponseWriter: w}
+			args = []reflect.Value{reflect.ValueOf(tracker), reflect.ValueOf(r), req.Elem()}
+		}
+
+		out := v.Call(args)
+		if err, _ := out[1].Interface().(error); err != nil {
+			ew.ServerError(w, r, err)
+			return
+		}
+		if tracker != nil && tracker.wrote {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out[0].Interface()); err != nil {
+			log.Printf("turtle: encode response: %v", err)
+		}
+	}
+}
+
+// writeTracker wraps an http.ResponseWriter to record whether the handler
+// wrote to it directly, so newTypedAdapter's (w, r, req) form doesn't also
+// encode its own response on top of one the handler already sent.
+type writeTracker struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (t *writeTracker) Write(p []byte) (int, error) {
+	t.wrote = true
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *writeTracker) WriteHeader(statusCode int) {
+	t.wrote = true
+	t.ResponseWriter.WriteHeader(statusCode)
+}
+
 type bundle struct {
 	bundler *Bundler
 	opts    O
 	chain   []HandleWrap
 }
 
+// ew returns the ErrorWriter to use for this bundle: the route's override if
+// set, falling back to the Bundler-wide default.
+func (b *bundle) ew() ErrorWriter {
+	return resolveErrorWriter(b.bundler.ew, b.opts.ErrorWriter)
+}
+
+// resolveErrorWriter returns routeEW if set, falling back to bundlerEW.
+func resolveErrorWriter(bundlerEW, routeEW ErrorWriter) ErrorWriter {
+	if routeEW != nil {
+		return routeEW
+	}
+	return bundlerEW
+}
+
 // authenticate attempts to authenticate a request for the configured schemes.
 func (b *bundle) authenticate(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Authentiate\n")
 		if b.opts.AuthMode == AUTHMODENONE {
 			next(w, r)
 			return
 		}
 
+		var challenges []string
 		for i, k := range b.opts.Schemes {
 			scheme, ok := b.bundler.schemes[k]
 			if !ok {
-				b.bundler.ew.ServerError(w, r, errors.New("authentication scheme not registered"))
+				b.ew().ServerError(w, r, errors.New("authentication scheme not registered"))
 				return
 			}
 			user, err := scheme.Authenticate(w, r)
 			if err != nil {
+				if challenger, ok := scheme.(Challenger); ok {
+					challenges = append(challenges, challenger.Challenge(r))
+				}
 				if b.opts.AuthMode == AUTHMODEREQUIRED {
 					// Last in the chain.
 					if i == len(b.opts.Schemes)-1 {
-						b.bundler.ew.Unauthorized(w, r, err)
+						for _, c := range challenges {
+							w.Header().Add("WWW-Authenticate", c)
+						}
+						b.ew().Unauthorized(w, r, err)
 						return
 					}
 				}
@@ -180,47 +375,106 @@ func (b *bundle) authenticate(next func(http.ResponseWriter, *http.Request)) fun
 	}
 }
 
-// authorize ensures the user from CtxCredentials has a valid role for the bundle.
+// requiredRoleGroups returns the effective OR-of-AND role groups for the bundle,
+// treating O.Roles as sugar for a single OR group. Bundler.New guarantees the
+// two fields are never both set and that no group in O.RequiredRoles is empty
+// (an empty AND group is vacuously satisfied by everyone).
+func (o O) requiredRoleGroups() [][]string {
+	if len(o.RequiredRoles) > 0 {
+		return o.RequiredRoles
+	}
+	if len(o.Roles) > 0 {
+		groups := make([][]string, len(o.Roles))
+		for i, role := range o.Roles {
+			groups[i] = []string{role}
+		}
+		return groups
+	}
+	return nil
+}
+
+// authorize ensures the user from CtxCredentials satisfies at least one
+// OR group of the bundle's required roles, where every role within a group
+// must be satisfied (AND).
 func (b *bundle) authorize(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	groups := b.opts.requiredRoleGroups()
 	return func(w http.ResponseWriter, r *http.Request) {
-		if len(b.opts.Roles) < 1 {
+		if len(groups) < 1 {
 			next(w, r)
 			return
 		}
 		roler, ok := r.Context().Value(CtxCredentials{}).(Roler)
 		if !ok {
-			b.bundler.ew.ServerError(w, r, errors.New("CtxCredentials does not implement Roler"))
+			b.ew().ServerError(w, r, errors.New("CtxCredentials does not implement Roler"))
 			return
 		}
 		var isAllowed bool
-		for _, r := range b.opts.Roles {
-			if roler.HasRole(r) {
+		var failed []string
+		for _, group := range groups {
+			satisfied := true
+			for _, role := range group {
+				if !roler.HasRole(role) {
+					satisfied = false
+					break
+				}
+			}
+			if satisfied {
 				isAllowed = true
 				break
 			}
+			failed = append(failed, "("+strings.Join(group, " AND ")+")")
 		}
 		if !isAllowed {
-			b.bundler.ew.Forbidden(w, r, fmt.Errorf("missing required roles: %s", strings.Join(b.opts.Roles, " ")))
+			b.ew().Forbidden(w, r, fmt.Errorf("missing required roles, none of the following groups were satisfied: %s", strings.Join(failed, " OR ")))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorizeScope ensures the user from CtxCredentials carries every scope
+// required by the bundle, independently of Roler-based authorization.
+func (b *bundle) authorizeScope(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(b.opts.Scopes) < 1 {
+			next(w, r)
 			return
 		}
+		scoper, ok := r.Context().Value(CtxCredentials{}).(Scoper)
+		if !ok {
+			b.ew().ServerError(w, r, errors.New("CtxCredentials does not implement Scoper"))
+			return
+		}
+		for _, scope := range b.opts.Scopes {
+			if !scoper.HasScope(scope) {
+				b.ew().Forbidden(w, r, fmt.Errorf("missing required scope: %s", scope))
+				return
+			}
+		}
 		next(w, r)
 	}
 }
 
 // allow checks the content-type header of a request and ensures that it is allowed.
+// An empty O.Allow means any content type is accepted.
 func (b *bundle) allow(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "DELETE" {
-			contentType := r.Header.Get("Conntent-Type")
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "DELETE" && len(b.opts.Allow) > 0 {
+			contentType := r.Header.Get("Content-Type")
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				b.ew().BadRequest(w, r, fmt.Errorf("invalid request content-type: %s", contentType))
+				return
+			}
 			var found bool
 			for _, allowed := range b.opts.Allow {
-				if strings.Contains(contentType, allowed) {
+				if mediaType == allowed {
 					found = true
 					break
 				}
 			}
 			if !found {
-				b.bundler.ew.BadRequest(w, r, fmt.Errorf("invalid request content-type: %s", contentType))
+				b.ew().BadRequest(w, r, fmt.Errorf("invalid request content-type: %s", contentType))
 				return
 			}
 		}
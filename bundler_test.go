@@ -0,0 +1,437 @@
+package turtle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testErrorWriter records which ErrorWriter method was called and writes a
+// matching status code, so tests can assert on both.
+type testErrorWriter struct {
+	unauthorized, serverError, forbidden, badRequest error
+}
+
+func (e *testErrorWriter) Unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	e.unauthorized = err
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (e *testErrorWriter) ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	e.serverError = err
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func (e *testErrorWriter) Forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	e.forbidden = err
+	w.WriteHeader(http.StatusForbidden)
+}
+
+func (e *testErrorWriter) BadRequest(w http.ResponseWriter, r *http.Request, err error) {
+	e.badRequest = err
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+// testCreds implements Roler and Scoper for use as CtxCredentials in tests.
+type testCreds struct {
+	roles  []string
+	scopes []string
+}
+
+func (c testCreds) HasRole(role string) bool {
+	for _, r := range c.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (c testCreds) HasScope(scope string) bool {
+	for _, s := range c.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// testScheme is a Scheme that either authenticates every request as creds,
+// or fails with err. It optionally implements Challenger via challenge.
+type testScheme struct {
+	creds     *testCreds
+	err       error
+	challenge string
+}
+
+func (s testScheme) Authenticate(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return *s.creds, nil
+}
+
+func (s testScheme) Challenge(r *http.Request) string {
+	return s.challenge
+}
+
+// nonChallengerScheme is a Scheme that deliberately does not implement
+// Challenger, unlike testScheme.
+type nonChallengerScheme struct {
+	err error
+}
+
+func (s nonChallengerScheme) Authenticate(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return nil, s.err
+}
+
+// newAuthorizedBundler returns a Bundler with a single scheme, "test",
+// registered that always authenticates as creds.
+func newAuthorizedBundler(ew ErrorWriter, creds testCreds) *Bundler {
+	b := NewBundler(ew)
+	b.RegisterScheme("test", testScheme{creds: &creds})
+	return b
+}
+
+func mustPanic(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic, got none")
+		}
+	}()
+	f()
+}
+
+func TestAuthorizeRequiredRoleGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		creds      testCreds
+		wantStatus int
+	}{
+		{"AND group fully satisfied", testCreds{roles: []string{"admin", "billing"}}, http.StatusOK},
+		{"alternate OR group satisfied", testCreds{roles: []string{"support"}}, http.StatusOK},
+		{"partial AND group is not enough", testCreds{roles: []string{"admin"}}, http.StatusForbidden},
+		{"unrelated role", testCreds{roles: []string{"guest"}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ew := &testErrorWriter{}
+			b := newAuthorizedBundler(ew, tt.creds)
+			handler := b.New(O{
+				AuthMode:      AUTHMODEREQUIRED,
+				Schemes:       []string{"test"},
+				RequiredRoles: [][]string{{"admin", "billing"}, {"support"}},
+				HandlerFunc:   func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+			})
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRolesSugar(t *testing.T) {
+	ew := &testErrorWriter{}
+	b := newAuthorizedBundler(ew, testCreds{roles: []string{"support"}})
+	handler := b.New(O{
+		AuthMode:    AUTHMODEREQUIRED,
+		Schemes:     []string{"test"},
+		Roles:       []string{"admin", "support"},
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+}
+
+func TestNewPanicsOnRolesAndRequiredRolesTogether(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	mustPanic(t, func() {
+		b.New(O{
+			AuthMode:      AUTHMODEREQUIRED,
+			Roles:         []string{"admin"},
+			RequiredRoles: [][]string{{"admin"}},
+			HandlerFunc:   func(w http.ResponseWriter, r *http.Request) {},
+		})
+	})
+}
+
+func TestNewPanicsOnEmptyRequiredRolesGroup(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	mustPanic(t, func() {
+		b.New(O{
+			AuthMode:      AUTHMODEREQUIRED,
+			RequiredRoles: [][]string{{}},
+			HandlerFunc:   func(w http.ResponseWriter, r *http.Request) {},
+		})
+	})
+}
+
+func TestRouteErrorWriterOverridesBundlerDefault(t *testing.T) {
+	bundlerEW := &testErrorWriter{}
+	routeEW := &testErrorWriter{}
+	b := NewBundler(bundlerEW)
+	b.RegisterScheme("test", testScheme{err: errors.New("bad credentials")})
+	handler := b.New(O{
+		AuthMode:    AUTHMODEREQUIRED,
+		Schemes:     []string{"test"},
+		ErrorWriter: routeEW,
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if routeEW.unauthorized == nil {
+		t.Fatal("expected route ErrorWriter to receive Unauthorized")
+	}
+	if bundlerEW.unauthorized != nil {
+		t.Fatal("expected Bundler-wide ErrorWriter to be bypassed by the route override")
+	}
+}
+
+func TestSetErrorWriterChangesBundlerDefault(t *testing.T) {
+	initial := &testErrorWriter{}
+	replacement := &testErrorWriter{}
+	b := NewBundler(initial)
+	b.RegisterScheme("test", testScheme{err: errors.New("bad credentials")})
+	b.SetErrorWriter(replacement)
+	handler := b.New(O{
+		AuthMode:    AUTHMODEREQUIRED,
+		Schemes:     []string{"test"},
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if replacement.unauthorized == nil {
+		t.Fatal("expected replacement ErrorWriter to receive Unauthorized")
+	}
+	if initial.unauthorized != nil {
+		t.Fatal("expected initial ErrorWriter to be replaced, not also called")
+	}
+}
+
+func TestAuthenticateAggregatesChallengesAcrossSchemes(t *testing.T) {
+	ew := &testErrorWriter{}
+	b := NewBundler(ew)
+	b.RegisterScheme("basic", testScheme{err: errors.New("bad basic"), challenge: `Basic realm="api"`})
+	b.RegisterScheme("bearer", testScheme{err: errors.New("bad bearer"), challenge: `Bearer realm="api"`})
+	handler := b.New(O{
+		AuthMode:    AUTHMODEREQUIRED,
+		Schemes:     []string{"basic", "bearer"},
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	got := rec.Header().Values("WWW-Authenticate")
+	want := []string{`Basic realm="api"`, `Bearer realm="api"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("WWW-Authenticate = %v, want %v", got, want)
+	}
+	if ew.unauthorized == nil {
+		t.Fatal("expected Unauthorized to be called after all schemes failed")
+	}
+}
+
+func TestAuthenticateOmitsChallengeForNonChallengerScheme(t *testing.T) {
+	ew := &testErrorWriter{}
+	b := NewBundler(ew)
+	b.RegisterScheme("opaque", nonChallengerScheme{err: errors.New("bad credentials")})
+	handler := b.New(O{
+		AuthMode:    AUTHMODEREQUIRED,
+		Schemes:     []string{"opaque"},
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := rec.Header().Values("WWW-Authenticate"); len(got) != 0 {
+		t.Fatalf("WWW-Authenticate = %v, want none", got)
+	}
+}
+
+type typedIn struct {
+	A string `json:"a"`
+}
+
+type typedOut struct {
+	B string `json:"b"`
+}
+
+func TestNewTypedDecodesAndEncodesJSON(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	handler := b.NewTyped(O{AuthMode: AUTHMODENONE}, func(w http.ResponseWriter, r *http.Request, req typedIn) (typedOut, error) {
+		return typedOut{B: req.A + "!"}, nil
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":"hi"}`)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var got typedOut
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got.B != "hi!" {
+		t.Fatalf("body = %+v, want B=%q", got, "hi!")
+	}
+}
+
+func TestNewTypedEmptyBodyDecodesToZeroValue(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	handler := b.NewTyped(O{AuthMode: AUTHMODENONE}, func(w http.ResponseWriter, r *http.Request, req typedIn) (typedOut, error) {
+		return typedOut{B: req.A}, nil
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 for an empty (GET) body", rec.Code)
+	}
+}
+
+// TestNewTypedDoesNotDoubleWriteManualResponse guards against the adapter
+// encoding its own JSON response on top of one a (w, r, req) handler already
+// wrote via the raw ResponseWriter it was handed.
+func TestNewTypedDoesNotDoubleWriteManualResponse(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	handler := b.NewTyped(O{AuthMode: AUTHMODENONE}, func(w http.ResponseWriter, r *http.Request, req typedIn) (typedOut, error) {
+		w.Write([]byte("manual-"))
+		return typedOut{B: "x"}, nil
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := rec.Body.String(); got != "manual-" {
+		t.Fatalf("body = %q, want %q (adapter must not also encode a response)", got, "manual-")
+	}
+}
+
+func TestNewTypedCredentialsForm(t *testing.T) {
+	creds := testCreds{roles: []string{"admin"}}
+	b := newAuthorizedBundler(&testErrorWriter{}, creds)
+	handler := b.NewTyped(O{
+		AuthMode: AUTHMODEREQUIRED,
+		Schemes:  []string{"test"},
+	}, func(ctx context.Context, c testCreds, req typedIn) (typedOut, error) {
+		return typedOut{B: c.roles[0]}, nil
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var got typedOut
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got.B != "admin" {
+		t.Fatalf("body = %+v, want B=%q", got, "admin")
+	}
+}
+
+func TestNewTypedPanicsOnNonJSONAllow(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	mustPanic(t, func() {
+		b.NewTyped(O{AuthMode: AUTHMODENONE, Allow: []string{"application/xml"}}, func(w http.ResponseWriter, r *http.Request, req typedIn) (typedOut, error) {
+			return typedOut{}, nil
+		})
+	})
+}
+
+func TestAuthorizeScope(t *testing.T) {
+	tests := []struct {
+		name       string
+		scopes     []string
+		required   []string
+		wantStatus int
+	}{
+		{"scope present", []string{"read:things"}, []string{"read:things"}, http.StatusOK},
+		{"scope missing", []string{"read:things"}, []string{"write:things"}, http.StatusForbidden},
+		{"one of several missing", []string{"read:things"}, []string{"read:things", "write:things"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ew := &testErrorWriter{}
+			b := newAuthorizedBundler(ew, testCreds{scopes: tt.scopes})
+			handler := b.New(O{
+				AuthMode:    AUTHMODEREQUIRED,
+				Schemes:     []string{"test"},
+				Scopes:      tt.required,
+				HandlerFunc: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+			})
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestNewPanicsOnScopesWithoutAuthModeRequired(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	mustPanic(t, func() {
+		b.New(O{
+			AuthMode:    AUTHMODENONE,
+			Scopes:      []string{"read:things"},
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+		})
+	})
+}
+
+func TestAllowContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow       []string
+		contentType string
+		wantStatus  int
+	}{
+		{"exact match", []string{"application/json"}, "application/json", http.StatusOK},
+		{"charset parameter ignored", []string{"application/json"}, "application/json; charset=utf-8", http.StatusOK},
+		{"mismatched type", []string{"application/json"}, "text/plain", http.StatusBadRequest},
+		{"empty Allow accepts anything", nil, "text/plain", http.StatusOK},
+		{"unparseable header", []string{"application/json"}, ";;;", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBundler(&testErrorWriter{})
+			handler := b.New(O{
+				AuthMode:    AUTHMODENONE,
+				Allow:       tt.allow,
+				HandlerFunc: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+			})
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.Header.Set("Content-Type", tt.contentType)
+			handler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAllowSkipsBodylessMethods(t *testing.T) {
+	b := NewBundler(&testErrorWriter{})
+	handler := b.New(O{
+		AuthMode:    AUTHMODENONE,
+		Allow:       []string{"application/json"},
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+	})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Content-Type", "text/plain")
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (GET should bypass the Allow check)", rec.Code)
+	}
+}